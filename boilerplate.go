@@ -2,9 +2,31 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 )
 
-var LOG_LEVEL = "error"
+var LOG_LEVEL = "warn"
+
+// log levels in increasing verbosity
+var log_levels = map[string]int{
+	"error": 0,
+	"warn": 1,
+	"info": 2,
+	"debug": 3,
+}
+
+// exit codes, see README
+const (
+	EXIT_VALIDATE = 1
+	EXIT_CONFIG = 2
+	EXIT_FETCH = 3
+	EXIT_COMPOSE = 4
+	EXIT_SAVE = 5
+	EXIT_HOOK = 6
+	EXIT_INTERRUPTED = 130
+)
 
 func check(err error, msg string) {
 	if err != nil {
@@ -13,8 +35,54 @@ func check(err error, msg string) {
 	}
 }
 
-func debug(msg ...string) {
-	if LOG_LEVEL == "debug" {
-		fmt.Println(msg)
+// print a key=value formatted log line if level is enabled.
+// fields are alternating keys and values
+func log_msg(level string, msg string, fields ...string) {
+	if log_levels[level] > log_levels[LOG_LEVEL] {
+		return
+	}
+
+	line := "level=" + level + " msg=" + strconv.Quote(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		// quoting also escapes newlines and other control characters, which
+		// would break the one line per entry format
+		if value == "" || strings.ContainsAny(value, " =") || strconv.Quote(value) != "\""+value+"\"" {
+			value = strconv.Quote(value)
+		}
+		line += " " + fields[i] + "=" + value
+	}
+	fmt.Println(line)
+}
+
+// log error and exit with the given code.  failures caused by SIGINT/SIGTERM
+// exit with EXIT_INTERRUPTED instead
+func fail(code int, msg string, err error) {
+	if ctx.Err() != nil {
+		code = EXIT_INTERRUPTED
+	}
+	log_error(msg, "err", err.Error())
+	os.Exit(code)
+}
+
+func fail_if(err error, code int, msg string) {
+	if err != nil {
+		fail(code, msg, err)
 	}
 }
+
+func debug(msg ...string) {
+	log_msg("debug", strings.Join(msg, " "))
+}
+
+func info(msg string, fields ...string) {
+	log_msg("info", msg, fields...)
+}
+
+func warn(msg string, fields ...string) {
+	log_msg("warn", msg, fields...)
+}
+
+func log_error(msg string, fields ...string) {
+	log_msg("error", msg, fields...)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+)
+
+// everything compose needs from the command line
+type compose_options struct {
+	aspect float64
+	mode   string
+	scale  float64
+	filter string
+	// -split images are already fitted to their halves
+	presized bool
+
+	tile_img     image.Image
+	tile_alpha   uint8
+	vignette     float64
+	border_width int
+	border_color color.Color
+	stamp        bool
+
+	invert_threshold float64
+	auto_theme       bool
+	coords           bool
+	lat, lon         float64
+
+	report_coverage bool
+	coverage_warn   float64
+}
+
+// rescale and post-process a downloaded image.  optional passes are skipped
+// once the refresh budget has run out.  now is used for -stamp and -auto-theme
+func compose(budget context.Context, img image.Image, opts compose_options, now time.Time) (result image.Image, err error) {
+	// image processing libraries panic on bad input, e.g. a zero sized image
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	optional := func(pass string) bool {
+		if budget.Err() != nil {
+			warn("Skipping pass, past -compose-deadline", "pass", pass)
+			return false
+		}
+		return true
+	}
+
+	if u, ok := img.(*image.Uniform); ok {
+		// solid sources have no size, fill the display instead of scaling
+		img = fill(u.C)
+	} else if !opts.presized {
+		img = crop_aspect(img, opts.aspect)
+		filter := opts.filter
+		if (filter == "area" || filter == "lanczos") && !optional(filter+" resize") {
+			filter = "bilinear"
+		}
+		// img = adjust(img, *top, *left, *right, *bottom)
+		img = adjust(img, opts.mode, opts.scale, filter)
+	}
+	if opts.tile_img != nil && optional("tile") {
+		img = tile(img, opts.tile_img, opts.tile_alpha)
+	}
+	img = vignette(img, opts.vignette)
+	img = border(img, opts.border_width, opts.border_color)
+	if opts.stamp {
+		img = stamp(img, now)
+	}
+
+	// mostly dark images ghost less when shown inverted.  always runs, so
+	// the choice doesn't flip with the refresh budget
+	if opts.invert_threshold > 0 {
+		if coverage := ink_coverage(img); coverage > opts.invert_threshold {
+			info("Auto-inverting image",
+				"coverage", fmt.Sprintf("%.3f", coverage),
+				"threshold", fmt.Sprintf("%.3f", opts.invert_threshold),
+			)
+			img = invert(img)
+		}
+	}
+
+	if opts.auto_theme && is_dark(now, opts.coords, opts.lat, opts.lon) {
+		info("Using dark theme")
+		img = invert(img)
+	}
+
+	if (opts.report_coverage || opts.coverage_warn > 0) && optional("coverage") {
+		coverage := ink_coverage(img)
+		if opts.report_coverage {
+			fmt.Printf("Ink coverage: %.1f%%\n", coverage*100)
+		}
+		if opts.coverage_warn > 0 && coverage > opts.coverage_warn {
+			warn("Ink coverage exceeds threshold, image may cause ghosting",
+				"coverage", fmt.Sprintf("%.3f", coverage),
+				"threshold", fmt.Sprintf("%.3f", opts.coverage_warn),
+			)
+		}
+	}
+
+	return img, ctx.Err()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+var update = flag.Bool("update", false, "rewrite golden images in testdata/")
+
+// compare img against testdata/name, or rewrite it with -update
+func check_golden(t *testing.T, img image.Image, name string) {
+	t.Helper()
+	path := "testdata/" + name
+	if *update {
+		if err := imaging.Save(img, path); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := imaging.Open(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if diff := image_diff(img, golden, 0); diff > 0 {
+		imaging.Save(img, os.TempDir()+"/"+name)
+		t.Errorf("%s differs from golden image in %.2f%% of pixels, got %s", name, diff*100, os.TempDir()+"/"+name)
+	}
+}
+
+// a landscape grayscale source with a gradient and some text, so scaling,
+// cropping and every pass show up in the output
+func test_source() image.Image {
+	src := image.NewGray(image.Rect(0, 0, 1600, 1000))
+	for y := 0; y < 1000; y++ {
+		for x := 0; x < 1600; x++ {
+			src.SetGray(x, y, color.Gray{uint8(x * 255 / 1600)})
+		}
+	}
+	text := render_text("golden", color.Black, color.White, 8)
+	draw.Draw(src, text.Bounds().Add(image.Pt(500, 400)), text, image.Point{}, draw.Src)
+	return src
+}
+
+func TestComposeGolden(t *testing.T) {
+	mark := render_text("rn", color.Black, color.White, 4)
+	opts := compose_options{
+		aspect:       4.0 / 3,
+		mode:         "fill",
+		scale:        1,
+		filter:       "bilinear",
+		tile_img:     mark,
+		tile_alpha:   48,
+		vignette:     0.4,
+		border_width: 12,
+		border_color: color.Black,
+		stamp:        true,
+	}
+	now := time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC)
+
+	img, err := compose(context.Background(), test_source(), opts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_golden(t, img, "compose.png")
+
+	// the fixed night hours at 20:00 invert the same screen
+	opts.auto_theme = true
+	dark, err := compose(context.Background(), test_source(), opts, now.Add(12*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_golden(t, dark, "compose-dark.png")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// height of the label strip under each contact sheet cell
+const label_height = 40
+
+// draw a label centered at the top of rect, at 2x the size of the builtin font
+func draw_label(dst draw.Image, rect image.Rectangle, label string) {
+	text := render_text(label, color.Black, color.White, 2)
+	x := rect.Min.X + (rect.Dx()-text.Bounds().Dx())/2
+	y := rect.Min.Y + (label_height-text.Bounds().Dy())/2
+	draw.Draw(dst, text.Bounds().Add(image.Pt(x, y)).Intersect(rect), text, image.Point{}, draw.Src)
+}
+
+// fetch each candidate and lay them out in a labelled grid for previewing.
+// fails if no candidate could be fetched
+func contact_sheet(candidates []string, format bool, xpath string) (image.Image, error) {
+	debug("Building contact sheet")
+
+	cols := int(math.Ceil(math.Sqrt(float64(len(candidates)))))
+	rows := (len(candidates) + cols - 1) / cols
+	cell_width := re_width / cols
+	cell_height := re_height / rows
+
+	sheet := imaging.New(re_width, re_height, color.White)
+	var err error
+	fetched_any := false
+	for i, name := range candidates {
+		cell := image.Rect(0, 0, cell_width, cell_height).Add(
+			image.Pt((i%cols)*cell_width, (i/cols)*cell_height),
+		)
+		label := name
+
+		var img image.Image
+		img, err = fetch_candidate(name, format, xpath)
+		if err != nil {
+			log_error("Download failed", "source", name, "err", err.Error())
+			label = name + " (failed)"
+		} else {
+			fetched_any = true
+			if u, ok := img.(*image.Uniform); ok {
+				img = fill(u.C)
+			}
+			// fit image in the space above the label
+			img = imaging.Fit(img, cell.Dx()-10, cell.Dy()-label_height-10, imaging.Linear)
+			offset := image.Pt(
+				cell.Min.X+(cell.Dx()-img.Bounds().Dx())/2,
+				cell.Min.Y+label_height+(cell.Dy()-label_height-img.Bounds().Dy())/2,
+			)
+			draw.Draw(sheet, img.Bounds().Add(offset), img, image.Point{}, draw.Src)
+		}
+
+		draw_label(sheet, cell, label)
+	}
+
+	// a sheet of failures is no preview, report the last error
+	if !fetched_any {
+		return nil, err
+	}
+	return sheet, nil
+}
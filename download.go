@@ -2,18 +2,116 @@ package main
 
 import (
 	"time"
+	"context"
+	"io"
+	"bytes"
+	"image"
 	"net/http"
+	"compress/gzip"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
 	"github.com/antchfx/htmlquery"
 	"github.com/antchfx/jsonquery"
-	// "fmt"
+	"fmt"
+	"strings"
 	"net/url"
 	"errors"
 	"strconv"
 	"github.com/lestrrat-go/strftime"
+	"github.com/disintegration/imaging"
 )
 
 var Err404 = errors.New("Err404")
 
+// wrapped by errors caused by options rather than the server, so main can exit
+// with EXIT_CONFIG
+var ErrInvalidXPath = errors.New("invalid XPath")
+var ErrInvalidFormat = errors.New("invalid strftime URL")
+
+// check an -xpath expression before anything is downloaded
+func check_xpath(xpath string) error {
+	doc, err := htmlquery.Parse(strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	_, err = htmlquery.QueryAll(doc, xpath)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidXPath, xpath, err)
+	}
+	return nil
+}
+
+// cancelled on SIGINT/SIGTERM, aborting any requests in progress
+var ctx = context.Background()
+
+// timezone used for strftime formatting and schedules
+var location = time.Local
+
+// shared client for all requests.  follows up to 10 redirects and uses
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment
+var client = &http.Client{}
+
+// send all requests through proxy (http://, https:// or socks5:// URL),
+// overriding the environment
+func set_proxy(proxy string) error {
+	proxy_url, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	switch proxy_url.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.New("unsupported proxy scheme: " + proxy_url.Scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy_url)
+	client.Transport = transport
+	return nil
+}
+
+// Accept header for image downloads, to steer content negotiating servers away
+// from formats we can't decode (WebP, AVIF)
+var accept = "image/png,image/jpeg;q=0.9,image/gif;q=0.5"
+
+// largest response body accepted, after decompression
+var max_download_bytes int64 = 25 << 20
+
+var ErrTooLarge = errors.New("download exceeds -max-download-bytes")
+
+// response body wrapper which fails once more than max bytes have been read
+type limited_body struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limited_body) Read(p []byte) (int, error) {
+	// read one byte past the limit so we can tell if it was exceeded
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// response body wrapper which closes both the decoder and the underlying body
+type decoded_body struct {
+	io.Reader
+	decoder io.Closer
+	body io.Closer
+}
+
+func (d decoded_body) Close() error {
+	d.decoder.Close()
+	return d.body.Close()
+}
+
 func to_absurl(base, rel string) (string, error) {
 	base_url, err := url.Parse(base)
 	if err != nil {
@@ -32,8 +130,30 @@ func to_absurl(base, rel string) (string, error) {
 }
 
 func get_url(url string) (*http.Response, error){
+	return get(url, "")
+}
+
+// like get_url, but asks for formats which can be decoded
+func get_image_url(url string) (*http.Response, error){
+	fetched.url = url
+	return get(url, accept)
+}
+
+func get(url string, accept string) (*http.Response, error){
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		debug("Invalid url:", url)
+		return nil, err
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	// ask for compression explicitly so we also handle servers which compress
+	// without being asked
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
+
 	// if http failure, wait for next reconnect
-	response, err := http.Get(url)
+	response, err := client.Do(request)
 	if err != nil {
 		debug("Failed to fetch url")
 		return response, err
@@ -48,23 +168,186 @@ func get_url(url string) (*http.Response, error){
 		return response, Err404
 	}
 
+	// ----- content decoding -----
+
+	switch response.Header.Get("Content-Encoding") {
+	case "gzip":
+		debug("Decoding gzip response")
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			debug("Failed to decode gzip response")
+			response.Body.Close()
+			return response, err
+		}
+		response.Body = decoded_body{reader, reader, response.Body}
+	case "deflate":
+		debug("Decoding deflate response")
+		reader := flate.NewReader(response.Body)
+		response.Body = decoded_body{reader, reader, response.Body}
+	}
+
+	// protect the device from running out of memory on huge downloads
+	if response.ContentLength > max_download_bytes && response.Header.Get("Content-Encoding") == "" {
+		debug("Response too large:", strconv.FormatInt(response.ContentLength, 10), "bytes")
+		response.Body.Close()
+		return response, ErrTooLarge
+	}
+	response.Body = &limited_body{response.Body, max_download_bytes}
+
 	return response, nil
 }
 
+// magic bytes of common formats which imaging can't decode
+var unsupported_formats = []struct {
+	name string
+	offset int
+	magic string
+}{
+	{"WebP", 8, "WEBP"},
+	{"AVIF", 4, "ftypavif"},
+	{"AVIF", 4, "ftypavis"},
+	{"HEIC", 4, "ftypheic"},
+	{"HEIC", 4, "ftypheix"},
+	{"HEIF", 4, "ftypmif1"},
+	{"JPEG XL", 0, "\xff\x0a"},
+	{"JPEG XL", 4, "JXL "},
+	{"PDF", 0, "%PDF"},
+}
+
+// guess the format of data which failed to decode
+func detect_format(data []byte) string {
+	for _, f := range unsupported_formats {
+		if len(data) >= f.offset && bytes.HasPrefix(data[f.offset:], []byte(f.magic)) {
+			return f.name
+		}
+	}
+
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	head = bytes.ToLower(bytes.TrimSpace(head))
+	if bytes.Contains(head, []byte("<svg")) {
+		return "SVG"
+	}
+	if bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html")) {
+		return "HTML"
+	}
+
+	return ""
+}
+
+var ErrPlaceholder = errors.New("got a known placeholder image")
+
+// SHA-256 hashes of images which servers send instead of the real one, e.g. a
+// CDN's "image not found" graphic.  repeatable -detect-placeholder flag
+type placeholder_list map[string]bool
+
+var placeholders = placeholder_list{}
+
+func (p placeholder_list) String() string {
+	var hashes []string
+	for hash := range p {
+		hashes = append(hashes, hash)
+	}
+	return strings.Join(hashes, ",")
+}
+
+// add a hex SHA-256 hash, or the hash of an image file
+func (p placeholder_list) Set(value string) error {
+	if _, err := hex.DecodeString(value); err == nil && len(value) == sha256.Size*2 {
+		p[strings.ToLower(value)] = true
+		return nil
+	}
+
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return errors.New("not a SHA-256 hash or readable file: " + value)
+	}
+	sum := sha256.Sum256(data)
+	p[hex.EncodeToString(sum[:])] = true
+	return nil
+}
+
+func decode_image(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		debug("Failed to read image")
+		return nil, err
+	}
+
+	if len(placeholders) > 0 {
+		sum := sha256.Sum256(data)
+		if hash := hex.EncodeToString(sum[:]); placeholders[hash] {
+			warn("Placeholder image detected", "sha256", hash)
+			return nil, ErrPlaceholder
+		}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		switch format := detect_format(data); format {
+		case "":
+			debug("Failed to decode image")
+		case "HTML":
+			err = errors.New("got an HTML page instead of an image, try -xpath to locate the <img> tag")
+		default:
+			err = errors.New("unsupported image format " + format + ", convert the image to PNG or JPEG, or try a different -accept")
+		}
+		return nil, err
+	}
+
+	return img, nil
+}
+// check that url is reachable without downloading it
+func head_url(url string) error {
+	request, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	// some servers don't implement HEAD, fall back to GET
+	if response.StatusCode == http.StatusMethodNotAllowed {
+		response, err = get_url(url)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		return nil
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("unexpected response code " + strconv.Itoa(response.StatusCode) + " from " + url)
+	}
+	return nil
+}
 
 func xpath_html(url, xpath string) (string, error) {
-	doc, err := htmlquery.LoadURL(url)
+	response, err := get_url(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	doc, err := htmlquery.Parse(response.Body)
 	if err != nil {
 		debug("Failed to parse HTML")
 		return "", err
 	}
 
 	list, err := htmlquery.QueryAll(doc, "//meta/text()")
-	check(err, "Invalid XPath")
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrInvalidXPath, xpath, err)
+	}
 
 	if len(list) == 0 {
 		debug("No XPath matches found")
-		return "", err
+		return "", errors.New("no XPath matches for " + xpath)
 	}
 
 	return htmlquery.InnerText(list[0]), nil
@@ -75,37 +358,45 @@ func get_xpath(url, xpath, data_format string) (string, error) {
 	// load the given URL and query the document with the given XPath expression
 	// returns string result
 
+	response, err := get_url(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
 	if data_format == "json" {
-		doc, err := jsonquery.LoadURL(url)
+		doc, err := jsonquery.Parse(response.Body)
 		if err != nil {
 			debug("Failed to parse JSON")
 			return "", err
 		}
 
 		list, err := jsonquery.QueryAll(doc, xpath)
-		check(err, "Invalid XPath")
+		if err != nil {
+			return "", fmt.Errorf("%w %s: %v", ErrInvalidXPath, xpath, err)
+		}
 
 		if len(list) == 0 {
 			debug("No XPath matches found")
-			// FIXME, err is nil
-			return "", err
+			return "", errors.New("no XPath matches for " + xpath)
 		}
 
 		return list[0].InnerText(), nil
 	} else if data_format == "html" {
-		doc, err := htmlquery.LoadURL(url)
+		doc, err := htmlquery.Parse(response.Body)
 		if err != nil {
 			debug("Failed to parse HTML")
 			return "", err
 		}
 
 		list, err := htmlquery.QueryAll(doc, xpath)
-		check(err, "Invalid XPath")
+		if err != nil {
+			return "", fmt.Errorf("%w %s: %v", ErrInvalidXPath, xpath, err)
+		}
 
 		if len(list) == 0 {
 			debug("No XPath matches found")
-			// FIXME, err is nil
-			return "", err
+			return "", errors.New("no XPath matches for " + xpath)
 		}
 
 		return htmlquery.InnerText(list[0]), nil
@@ -114,8 +405,12 @@ func get_xpath(url, xpath, data_format string) (string, error) {
 	panic(`Invalid data_format`)
 }
 
-func format_url(url string) string {
-	// format url containing strftime-style datecodes
+func format_url(url string) (string, error) {
+	return format_url_at(url, time.Now().In(location))
+}
+
+func format_url_at(url string, date time.Time) (string, error) {
+	// format url containing strftime-style datecodes for the given date
 
 	// add custom format code %e for non-zero-padded day
 	format_e := strftime.AppendFunc(func(b []byte, t time.Time) []byte {
@@ -128,9 +423,11 @@ func format_url(url string) string {
 		url,
 		strftime.WithSpecification('e', format_e),
 	)
-	check(err, "")
-	url = f.FormatString(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrInvalidFormat, url, err)
+	}
+	url = f.FormatString(date)
 	debug("strftime formatted URL:", url)
 
-	return url
+	return url, nil
 }
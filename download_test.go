@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a small PNG to serve
+func test_png(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// download and decode url, checking it was the test PNG
+func fetch_test_png(t *testing.T, url string) {
+	t.Helper()
+	response, err := get_image_url(url)
+	if err != nil {
+		t.Fatalf("get_image_url(%s): %v", url, err)
+	}
+	defer response.Body.Close()
+
+	img, err := decode_image(response.Body)
+	if err != nil {
+		t.Fatalf("decode_image: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 40, 30) {
+		t.Errorf("got image bounds %v, want 40x30", img.Bounds())
+	}
+}
+
+func TestGetRedirectGzip(t *testing.T) {
+	data := test_png(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/image.png", http.StatusFound)
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(data)
+		gz.Close()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetch_test_png(t, server.URL+"/latest")
+}
+
+func TestGetDeflate(t *testing.T) {
+	data := test_png(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		fl, _ := flate.NewWriter(w, flate.DefaultCompression)
+		fl.Write(data)
+		fl.Close()
+	}))
+	defer server.Close()
+
+	fetch_test_png(t, server.URL)
+}
+
+func TestGetTooLarge(t *testing.T) {
+	defer func(limit int64) { max_download_bytes = limit }(max_download_bytes)
+	max_download_bytes = 1000
+
+	big := bytes.Repeat([]byte("x"), 5000)
+	mux := http.NewServeMux()
+	// Content-Length is known up front
+	mux.HandleFunc("/sized", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5000")
+		w.Write(big)
+	})
+	// chunked, so the limit is only hit partway through reading
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write(big[:1000])
+			w.(http.Flusher).Flush()
+		}
+	})
+	// small on the wire, large once decompressed
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(big)
+		gz.Close()
+	})
+	// exactly at the limit is fine
+	mux.HandleFunc("/limit", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(big[:1000])
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	_, err := get_url(server.URL + "/sized")
+	if err != ErrTooLarge {
+		t.Errorf("/sized: got err %v, want ErrTooLarge before reading", err)
+	}
+
+	for _, path := range []string{"/chunked", "/gzip", "/limit"} {
+		response, err := get_url(server.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+		want := ErrTooLarge
+		if path == "/limit" {
+			want = nil
+		}
+		if err != want {
+			t.Errorf("%s: got read err %v, want %v", path, err, want)
+		}
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	defer func(transport http.RoundTripper) { client.Transport = transport }(client.Transport)
+
+	data := test_png(t)
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy sees the full URL of the origin server
+		proxied = r.URL.String()
+		w.Write(data)
+	}))
+	defer proxy.Close()
+
+	if err := set_proxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	fetch_test_png(t, "http://news.example.invalid/today.png")
+	if proxied != "http://news.example.invalid/today.png" {
+		t.Errorf("proxy got request for %q", proxied)
+	}
+}
+
+func TestSetProxyScheme(t *testing.T) {
+	defer func(transport http.RoundTripper) { client.Transport = transport }(client.Transport)
+
+	for _, proxy := range []string{"ftp://proxy:21", "proxy:3128"} {
+		if err := set_proxy(proxy); err == nil {
+			t.Errorf("set_proxy(%q) accepted unsupported scheme", proxy)
+		}
+	}
+	if client.Transport != nil {
+		t.Error("rejected proxy changed the client transport")
+	}
+}
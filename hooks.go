@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// run a -pre-hook/-post-hook shell command, passing details of the image in
+// RENEWS_* environment variables.  output is copied to the log
+func run_hook(name, command string, timeout time.Duration, output string) error {
+	if command == "" {
+		return nil
+	}
+	debug("Running hook", name)
+
+	hook_ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// own process group, so a timeout also kills children of the shell which
+	// would otherwise keep the output pipe open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		"RENEWS_HOOK="+name,
+		"RENEWS_OUTPUT="+output,
+		"RENEWS_SOURCE="+fetched.source,
+		"RENEWS_URL="+fetched.url,
+		"RENEWS_TITLE="+fetched.title,
+	)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	killed := false
+	select {
+	case err = <-done:
+	case <-hook_ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		killed = true
+		err = <-done
+	}
+
+	if text := strings.TrimSpace(out.String()); text != "" {
+		info("Hook output", "hook", name, "output", text)
+	}
+	if killed && hook_ctx.Err() == context.DeadlineExceeded {
+		return errors.New(name + " timed out after " + timeout.String())
+	}
+	return err
+}
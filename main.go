@@ -4,29 +4,102 @@ import (
 	"flag"
 	"time"
 	"fmt"
+	"errors"
+	"context"
+	"os/signal"
+	"syscall"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"image"
+
 	"github.com/disintegration/imaging"
 )
 
+// set at build time, see Makefile
+var version = "dev"
+var commit = "unknown"
+var build_date = "unknown"
+
 func main() {
 	// ----- flag parsing -----
 
 	url := flag.String("url", "", "input URL")
 	output := flag.String("output", "", "output image path")
-	source := flag.String("source", "", "use builtin source and scaling options")
+	var source_names source_list
+	flag.Var(&source_names, "source", "use builtin source and scaling options (repeatable, tried in order before -url)")
+	pick_strategy := flag.String("pick", pick, "how a dir:<path> source chooses an image (random, sequential, daily)")
 	format := flag.Bool("strftime", false, "enable strftime formatting in URL")
-	verbose := flag.Bool("verbose", false, "enable debug output")
+	verbose := flag.Bool("verbose", false, "enable debug output (same as -log-level debug)")
+	log_level := flag.String("log-level", LOG_LEVEL, "log level (error, warn, info, debug)")
 	xpath := flag.String("xpath", "", "xpath to <img> tag in url")
 	test := flag.Bool("test", false, "disable wait-online and cooldown")
+	width := flag.Int("width", re_width, "output width in pixels")
+	height := flag.Int("height", re_height, "output height in pixels")
 	mode := flag.String("mode", "fill", "image scaling mode (fill, center)")
 	scale := flag.Float64("scale", 1, "scale image prior to centering")
+	filter := flag.String("resize", "bilinear", "resampling filter for scaling (nearest, bilinear, area, lanczos)")
+	aspect_spec := flag.String("crop-aspect", "", "center crop image to aspect ratio before scaling (e.g. 16:9, 4:3, panel)")
+	border_spec := flag.String("border", "", "draw border around image (width,color)")
+	tile_spec := flag.String("tile", "", "repeat a watermark image across the output (path,alpha=N)")
+	vignette_strength := flag.Float64("vignette", 0, "darken the corners by up to this fraction (0-1, 0 to disable)")
+	show_stamp := flag.Bool("stamp", false, "draw the time the image was made in the bottom right corner")
+	compose_deadline := flag.Duration("compose-deadline", 0, "skip optional passes (area/lanczos resize, -tile, coverage report) if a refresh takes longer than this, e.g. 20s")
+	report_coverage := flag.Bool("report-coverage", false, "print fraction of dark pixels in the final image")
+	coverage_warn := flag.Float64("coverage-warn", 0, "warn when dark pixel fraction exceeds this (0-1, 0 to disable)")
+	invert_threshold := flag.Float64("auto-invert-threshold", 0, "invert the final image, timestamp included, when dark pixel fraction exceeds this (0-1, 0 to disable)")
+	auto_theme := flag.Bool("auto-theme", false, "invert the final image between sunset and sunrise at -lat/-lon (19:00-07:00 without coordinates)")
+	lat := flag.Float64("lat", 0, "latitude for -auto-theme, north positive")
+	lon := flag.Float64("lon", 0, "longitude for -auto-theme, east positive")
+	report_diff := flag.Bool("diff", false, "print how much the new image differs from the existing output image")
+	date_range := flag.String("range", "", "save one image per day for dates start..end (YYYY-MM-DD..YYYY-MM-DD) into -output directory, then quit. requires -strftime")
+	jpeg_quality_flag := flag.Int("jpeg-quality", jpeg_quality, "quality of .jpg output (1-100)")
+	jpeg_gray_flag := flag.Bool("jpeg-gray", jpeg_gray, "save .jpg output without color, which is much smaller")
+	thumbnail_spec := flag.String("thumbnail", "", "also save a copy of each image scaled down to width, keeping aspect (path,width)")
+	range_format := flag.String("range-format", "png", "file format of -range images (png, jpg, pgm, ...)")
+	write_sidecar := flag.Bool("sidecar", false, "write a JSON description of the image next to it (<output>.json)")
+	check_only := flag.Bool("validate", false, "check options, source reachability and output path, then quit")
+	split_mode := flag.String("split", "", "show the two sources/URLs given as arguments in the left/right (vertical) or top/bottom (horizontal) halves")
+	sheet := flag.Bool("contact-sheet", false, "save a preview grid of the sources/URLs given as arguments, then quit")
 	// top := flag.Int("top", 0, "crop from top")
 	// left := flag.Int("left", 0, "crop from left")
 	// right := flag.Int("right", 0, "crop from right")
 	// bottom := flag.Int("bottom", 0, "crop from bottom")
+	flag.Var(placeholders, "detect-placeholder", "treat an image as a failed download if it matches this SHA-256 hash or image file (repeatable)")
+	var schedule schedule_list
+	flag.Var(&schedule, "schedule", "use source/URL between times of day (HH:MM-HH:MM=source, repeatable).  equal times mean all day")
+	timezone := flag.String("timezone", "Local", "timezone for schedules and strftime formatting (e.g. Europe/London)")
+	proxy := flag.String("proxy", "", "proxy for all requests, e.g. http://host:3128 or socks5://host:1080 (default from HTTP_PROXY/HTTPS_PROXY)")
+	max_bytes := flag.Int64("max-download-bytes", max_download_bytes, "largest download accepted, in bytes")
+	accept_header := flag.String("accept", accept, "Accept header sent when downloading images")
+	push_url := flag.String("push-url", "", "also POST each saved image as a PNG to this URL")
+	push_token_file := flag.String("push-token-file", "", "file holding the bearer token sent with -push-url (default from RENEWS_PUSH_TOKEN)")
+	push_timeout := flag.Duration("push-timeout", time.Minute, "give up on -push-url uploads which take longer than this")
+	pre_hook := flag.String("pre-hook", "", "shell command to run before each download")
+	post_hook := flag.String("post-hook", "", "shell command to run after each image is saved, with RENEWS_OUTPUT/RENEWS_SOURCE/RENEWS_URL/RENEWS_TITLE set")
+	hook_timeout := flag.Duration("hook-timeout", 30*time.Second, "kill hooks which take longer than this")
+	hook_abort := flag.Bool("hook-abort", false, "treat a failing hook as a failed refresh instead of only logging it")
+	show_version := flag.Bool("version", false, "print version and build info, then quit")
 	cooldown := flag.Int("cooldown", 3600, "minimum seconds to wait before attempting download again")
 	flag.Parse()
 
+	// cancel downloads and saves in progress on Ctrl-C or systemctl stop
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *show_version {
+		fmt.Printf("remarkable_news %s (commit %s, built %s, %s %s/%s)\n",
+			version, commit, build_date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return
+	}
+
+	if _, ok := log_levels[*log_level]; !ok {
+		fail(EXIT_CONFIG, "Invalid -log-level", errors.New(*log_level))
+	}
+	LOG_LEVEL = *log_level
 	if *verbose {
 		LOG_LEVEL = "debug"
 	}
@@ -34,22 +107,353 @@ func main() {
 	var img image.Image
 	var err error
 
-	// download/rescale image, then quit
-	if *test {
-		// use a built-in image source
-		if *source != "" {
-			img, err = sources[*source]()
-		} else {
-			img, err = custom(*url, *format, *xpath)
+	accept = *accept_header
+	if *jpeg_quality_flag < 1 || *jpeg_quality_flag > 100 {
+		fail(EXIT_CONFIG, "Invalid -jpeg-quality", errors.New("must be between 1 and 100"))
+	}
+	jpeg_quality, jpeg_gray = *jpeg_quality_flag, *jpeg_gray_flag
+	if *max_bytes <= 0 {
+		fail(EXIT_CONFIG, "Invalid -max-download-bytes", errors.New("must be positive"))
+	}
+	max_download_bytes = *max_bytes
+	pick = *pick_strategy
+	if pick != "random" && pick != "sequential" && pick != "daily" {
+		fail(EXIT_CONFIG, "Invalid -pick", errors.New("unknown strategy "+pick))
+	}
+	if *proxy != "" {
+		err = set_proxy(*proxy)
+		fail_if(err, EXIT_CONFIG, "Invalid -proxy")
+	}
+
+	if *vignette_strength < 0 || *vignette_strength > 1 {
+		fail(EXIT_CONFIG, "Invalid -vignette", errors.New("must be between 0 and 1"))
+	}
+	if *invert_threshold < 0 || *invert_threshold > 1 {
+		fail(EXIT_CONFIG, "Invalid -auto-invert-threshold", errors.New("must be between 0 and 1"))
+	}
+	// 0,0 is a valid location, so look at which flags were actually given
+	coords := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		coords[f.Name] = true
+	})
+	if coords["lat"] != coords["lon"] {
+		fail(EXIT_CONFIG, "Invalid -lat/-lon", errors.New("both or neither must be given"))
+	}
+	if *lat < -90 || *lat > 90 || *lon < -180 || *lon > 180 {
+		fail(EXIT_CONFIG, "Invalid -lat/-lon", errors.New("out of range"))
+	}
+	if *width <= 0 || *height <= 0 {
+		fail(EXIT_CONFIG, "Invalid -width/-height", errors.New("must be positive"))
+	}
+	re_width, re_height = *width, *height
+	known := false
+	for _, size := range device_sizes {
+		known = known || size == image.Pt(re_width, re_height)
+	}
+	if !known {
+		warn("Output size doesn't match any known device", "width", strconv.Itoa(re_width), "height", strconv.Itoa(re_height))
+	}
+
+	location, err = time.LoadLocation(*timezone)
+	fail_if(err, EXIT_CONFIG, "Invalid -timezone")
+
+	border_width, border_color, err := parse_border(*border_spec)
+	fail_if(err, EXIT_CONFIG, "Invalid -border")
+	if !resize_filters[*filter] {
+		fail(EXIT_CONFIG, "Invalid -resize", errors.New("unknown filter "+*filter))
+	}
+	aspect, err := parse_aspect(*aspect_spec)
+	fail_if(err, EXIT_CONFIG, "Invalid -crop-aspect")
+	if *xpath != "" {
+		err = check_xpath(*xpath)
+		fail_if(err, EXIT_CONFIG, "Invalid -xpath")
+	}
+	if *format && *url != "" {
+		_, err = format_url(*url)
+		fail_if(err, EXIT_CONFIG, "Invalid -url")
+	}
+	tile_img, tile_alpha, err := parse_tile(*tile_spec)
+	fail_if(err, EXIT_CONFIG, "Invalid -tile")
+	push_token, err := read_push_token(*push_token_file)
+	fail_if(err, EXIT_CONFIG, "Invalid -push-token-file")
+	thumbnail_path, thumbnail_width, err := parse_thumbnail(*thumbnail_spec)
+	fail_if(err, EXIT_CONFIG, "Invalid -thumbnail")
+	// -validate reports unknown sources itself
+	for _, name := range source_names {
+		if _, ok := lookup_source(name); !ok && !*check_only {
+			fail(EXIT_CONFIG, "Invalid -source", errors.New("unknown source "+name))
+		}
+	}
+	for _, e := range schedule {
+		if err := check_candidate(e.source); err != nil && !*check_only {
+			fail(EXIT_CONFIG, "Invalid -schedule", err)
+		}
+	}
+
+	switch *split_mode {
+	case "", "vertical", "horizontal":
+	default:
+		fail(EXIT_CONFIG, "Invalid -split", errors.New("unknown direction "+*split_mode))
+	}
+	if *split_mode != "" && flag.NArg() != 2 {
+		fail(EXIT_CONFIG, "Invalid -split", errors.New("requires two source or URL arguments"))
+	}
+
+	// use the scheduled source, or try each built-in image source and then the
+	// custom url until one succeeds
+	download := func() (image.Image, error) {
+		if *split_mode != "" {
+			// fit each half on its own, compose() then skips scaling
+			half := image.Pt(re_width/2, re_height)
+			if *split_mode == "horizontal" {
+				half = image.Pt(re_width, re_height/2)
+			}
+
+			var halves [2]image.Image
+			for i, name := range flag.Args() {
+				fetched = fetch_info{source: name}
+				img, err := fetch_candidate(name, *format, *xpath)
+				if err != nil {
+					return nil, err
+				}
+				if u, ok := img.(*image.Uniform); ok {
+					img = imaging.New(half.X, half.Y, u.C)
+				}
+				img = crop_aspect(img, aspect)
+				halves[i] = adjust_to(img, half.X, half.Y, *mode, *scale, *filter)
+			}
+			fetched = fetch_info{source: "split"}
+			return split(halves[0], halves[1], *split_mode), nil
+		}
+
+		if name, ok := schedule.pick(time.Now().In(location)); ok {
+			debug("Using scheduled source", name)
+			fetched = fetch_info{source: name}
+			return fetch_candidate(name, *format, *xpath)
+		}
+
+		candidates := source_names
+		if *url != "" || len(candidates) == 0 {
+			candidates = append(candidates[:len(candidates):len(candidates)], *url)
+		}
+
+		var err error
+		for _, name := range candidates {
+			fetched = fetch_info{source: name}
+			if name == *url {
+				fetched.source = "custom"
+			}
+
+			var img image.Image
+			img, err = fetch_candidate(name, *format, *xpath)
+			if err == nil {
+				if len(candidates) > 1 {
+					info("Downloaded image", "source", fetched.source)
+				}
+				return img, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			if len(candidates) > 1 {
+				warn("Source failed", "source", fetched.source, "err", err.Error())
+			}
+		}
+		return nil, err
+	}
+
+	// budget for a single refresh, from download to save
+	refresh := func() (context.Context, context.CancelFunc) {
+		if *compose_deadline > 0 {
+			return context.WithTimeout(ctx, *compose_deadline)
+		}
+		return context.WithCancel(ctx)
+	}
+
+	opts := compose_options{
+		aspect: aspect,
+		mode: *mode,
+		scale: *scale,
+		filter: *filter,
+		presized: *split_mode != "",
+		tile_img: tile_img,
+		tile_alpha: tile_alpha,
+		vignette: *vignette_strength,
+		border_width: border_width,
+		border_color: border_color,
+		stamp: *show_stamp,
+		invert_threshold: *invert_threshold,
+		auto_theme: *auto_theme,
+		coords: coords["lat"],
+		lat: *lat,
+		lon: *lon,
+		report_coverage: *report_coverage,
+		coverage_warn: *coverage_warn,
+	}
+
+	// run a hook, only returning its error if it should abort the refresh
+	hook := func(name, command string) error {
+		err := run_hook(name, command, *hook_timeout, *output)
+		if err == nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if *hook_abort {
+			return err
+		}
+		warn("Hook failed", "hook", name, "err", err.Error())
+		return nil
+	}
+
+	save := func(img image.Image, output string) error {
+		if *report_diff {
+			existing, err := imaging.Open(output)
+			if err != nil {
+				info("No existing image to compare against", "path", output, "err", err.Error())
+			} else {
+				fmt.Printf("Difference from existing image: %.1f%%\n", image_diff(img, existing, 16)*100)
+			}
 		}
 
+		err := save_image(img, output)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		// img = adjust(img, *top, *left, *right, *bottom)
-		img = adjust(img, *mode, *scale)
-		imaging.Save(img, *output)
-		debug("Image saved to ", *output)
+		info("Image saved", "path", output)
+
+		if *write_sidecar {
+			err = save_sidecar(img, output+".json", fetched)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// save the suspend screen, its thumbnail, and send it to -push-url
+	deploy := func(img image.Image) error {
+		err := save(img, *output)
+		if err != nil {
+			return err
+		}
+
+		if thumbnail_path != "" {
+			err = save_image(resize_image(img, thumbnail_width, "area"), thumbnail_path)
+			if err != nil {
+				return err
+			}
+			info("Thumbnail saved", "path", thumbnail_path)
+		}
+
+		if *push_url != "" {
+			err = push_image(img, *push_url, push_token, *push_timeout)
+			if err != nil {
+				return err
+			}
+			info("Image pushed", "url", *push_url)
+		}
+		return nil
+	}
+
+	// check everything but the actual download, then quit
+	if *check_only {
+		problems := validate(source_names, schedule, *url, *format, *output)
+		for _, problem := range problems {
+			log_error("Validation failed", "err", problem.Error())
+		}
+
+		// describe the candidate a real run would try first
+		if *write_sidecar && *output != "" {
+			planned := fetch_info{source: "custom", url: *url}
+			if name, ok := schedule.pick(time.Now().In(location)); ok {
+				planned = fetch_info{source: name}
+			} else if len(source_names) > 0 {
+				planned = fetch_info{source: source_names[0], url: source_urls[source_names[0]]}
+			}
+			if planned.source == "custom" && *format {
+				planned.url, _ = format_url(planned.url)
+			}
+			err = save_plan_sidecar(*output+".json", planned)
+			fail_if(err, EXIT_SAVE, "Failed to save sidecar")
+		}
+		if len(problems) > 0 {
+			os.Exit(EXIT_VALIDATE)
+		}
+		info("Validation passed")
+		return
+	}
+
+	// download all candidates into a preview grid, then quit
+	if *sheet {
+		if flag.NArg() == 0 {
+			fail(EXIT_CONFIG, "Invalid -contact-sheet", errors.New("requires at least one source or URL argument"))
+		}
+		img, err = contact_sheet(flag.Args(), *format, *xpath)
+		fail_if(err, EXIT_FETCH, "All contact sheet downloads failed")
+		err = save(img, *output)
+		fail_if(err, EXIT_SAVE, "Failed to save image")
+		return
+	}
+
+	// download/rescale an image for each day, then quit
+	if *date_range != "" {
+		start, end, err := parse_range(*date_range)
+		fail_if(err, EXIT_CONFIG, "Invalid -range")
+		if !*format || *url == "" {
+			fail(EXIT_CONFIG, "Invalid -range", errors.New("requires -url with -strftime"))
+		}
+		ext := "." + strings.TrimPrefix(strings.ToLower(*range_format), ".")
+		if _, err := imaging.FormatFromExtension(ext); err != nil && ext != ".pgm" {
+			fail(EXIT_CONFIG, "Invalid -range-format", errors.New("unknown format "+*range_format))
+		}
+		err = os.MkdirAll(*output, 0755)
+		fail_if(err, EXIT_SAVE, "Failed to create output directory")
+
+		for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+			fail_if(ctx.Err(), EXIT_INTERRUPTED, "Interrupted")
+			day := date.Format("2006-01-02")
+
+			budget, done := refresh()
+			day_url, err := format_url_at(*url, date)
+			fail_if(err, EXIT_CONFIG, "Invalid -url")
+			img, err = custom(day_url, false, *xpath)
+			if err == nil {
+				img, err = compose(budget, img, opts, time.Now().In(location))
+			}
+			done()
+			if err != nil {
+				warn("Skipping day", "date", day, "err", err.Error())
+				continue
+			}
+			err = save(img, filepath.Join(*output, day+ext))
+			fail_if(err, EXIT_SAVE, "Failed to save image")
+		}
+		return
+	}
+
+	// download/rescale image, then quit
+	if *test {
+		budget, done := refresh()
+		defer done()
+
+		// nothing is known about the image yet
+		fetched = fetch_info{}
+		err = hook("pre-hook", *pre_hook)
+		fail_if(err, EXIT_HOOK, "Hook failed")
+
+		img, err = download()
+		if errors.Is(err, ErrInvalidXPath) || errors.Is(err, ErrInvalidFormat) {
+			fail(EXIT_CONFIG, "Download failed", err)
+		}
+		fail_if(err, EXIT_FETCH, "Download failed")
+
+		img, err = compose(budget, img, opts, time.Now().In(location))
+		fail_if(err, EXIT_COMPOSE, "Failed to process image")
+
+		err = deploy(img)
+		fail_if(err, EXIT_SAVE, "Failed to save image")
+
+		err = hook("post-hook", *post_hook)
+		fail_if(err, EXIT_HOOK, "Hook failed")
 	} else {
 		// initialize with zero date
 		time_last_success := time.Time{};
@@ -60,36 +464,66 @@ func main() {
 		// loop forever and wait for network online events
 		for {
 			// wait for network online message from wpa supplicant
-			<- online
+			select {
+			case <- online:
+			case <- ctx.Done():
+				info("Shutting down")
+				return
+			}
 			debug("Network online")
 
 			// FIXME - need to wait a few seconds for DNS?
-			time.Sleep(5 * time.Second)
+			select {
+			case <- time.After(5 * time.Second):
+			case <- ctx.Done():
+				info("Shutting down")
+				return
+			}
 
 			// make sure we don't hammer server every time wifi is turned on
-			if time.Now().Sub(time_last_success).Seconds() > float64(*cooldown) {
+			if time.Now().Sub(time_last_success).Seconds() <= float64(*cooldown) {
+				debug("Hit cooldown limit")
+				continue
+			}
 
-				if *source != "" {
-					img, err = sources[*source]()
-				} else {
-					img, err = custom(*url, *format, *xpath)
-				}
+			// don't pass the previous refresh's image to the pre-hook
+			fetched = fetch_info{}
+			err = hook("pre-hook", *pre_hook)
+			if err != nil {
+				log_error("Hook failed", "hook", "pre-hook", "err", err.Error())
+				continue
+			}
 
-				if err == nil {
-					time_last_success = time.Now()
-				} else {
-					fmt.Println(err)
-					continue
-				}
-			} else {
-				debug("Hit cooldown limit")
+			budget, done := refresh()
+			img, err = download()
+			if err != nil {
+				done()
+				log_error("Download failed", "err", err.Error())
+				continue
+			}
+
+			img, err = compose(budget, img, opts, time.Now().In(location))
+			done()
+			if err != nil {
+				log_error("Failed to process image", "err", err.Error())
+				continue
+			}
+
+			err = deploy(img)
+			if err != nil {
+				log_error("Failed to save image", "err", err.Error())
+				continue
+			}
+
+			err = hook("post-hook", *post_hook)
+			if err != nil {
+				log_error("Hook failed", "hook", "post-hook", "err", err.Error())
 				continue
 			}
 
-			// img = adjust(img, *top, *left, *right, *bottom)
-			img = adjust(img, *mode, *scale)
-			imaging.Save(img, *output)
-			debug("Image saved to ", *output)
+			// only start the cooldown once the screen is updated, so failures
+			// are retried on the next WiFi connect
+			time_last_success = time.Now()
 		}
 	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// quality of .jpg output, 1-100
+var jpeg_quality = 95
+
+// drop color from .jpg output.  *image.Gray images are always saved as
+// grayscale JPEGs
+var jpeg_gray = false
+
+// save image to path, choosing the format from the file extension.  the image
+// is written to a temporary file first and renamed into place, so an
+// interrupted save never leaves a half written suspend screen
+func save_image(img image.Image, path string) error {
+	encode := func(w io.Writer) error {
+		return write_pgm(w, img)
+	}
+	if strings.ToLower(filepath.Ext(path)) != ".pgm" {
+		format, err := imaging.FormatFromFilename(path)
+		if err != nil {
+			return err
+		}
+		if format == imaging.JPEG && jpeg_gray {
+			if _, ok := img.(*image.Gray); !ok {
+				gray := image.NewGray(img.Bounds())
+				draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+				img = gray
+			}
+		}
+		encode = func(w io.Writer) error {
+			return imaging.Encode(w, img, format, imaging.JPEGQuality(jpeg_quality))
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	// no-op once renamed
+	defer os.Remove(f.Name())
+
+	err = encode(f)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// read the -push-url bearer token from path, or from RENEWS_PUSH_TOKEN if no
+// path is given, so it doesn't show up in ps or unit files
+func read_push_token(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("RENEWS_PUSH_TOKEN"), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// upload image as a PNG to an HTTP endpoint on the device, for firmware without
+// shell access.  token, if given, is sent as a bearer token.  gives up after
+// timeout so a stalled endpoint can't hang the service
+func push_image(img image.Image, url, token string, timeout time.Duration) error {
+	var body bytes.Buffer
+	err := png.Encode(&body, img)
+	if err != nil {
+		return err
+	}
+
+	push_ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(push_ctx, "POST", url, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "image/png")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// servers usually explain the rejection in the first line of the body
+		reason, _ := bufio.NewReader(io.LimitReader(response.Body, 200)).ReadString('\n')
+		return errors.New("push rejected with " + response.Status + ": " + strings.TrimSpace(reason))
+	}
+	return nil
+}
+
+// parse a thumbnail spec of the form "path,width".  empty spec means no
+// thumbnail
+func parse_thumbnail(spec string) (string, int, error) {
+	if spec == "" {
+		return "", 0, nil
+	}
+
+	i := strings.LastIndex(spec, ",")
+	if i <= 0 {
+		return "", 0, errors.New("thumbnail must be of the form path,width")
+	}
+	width, err := strconv.Atoi(spec[i+1:])
+	if err != nil || width <= 0 {
+		return "", 0, errors.New("invalid thumbnail width: " + spec[i+1:])
+	}
+	if _, err := imaging.FormatFromFilename(spec[:i]); err != nil && strings.ToLower(filepath.Ext(spec[:i])) != ".pgm" {
+		return "", 0, err
+	}
+
+	return spec[:i], width, nil
+}
+
+// write image as binary (P5) grayscale PGM, which is easy to diff and inspect
+func write_pgm(out io.Writer, img image.Image) error {
+	b := img.Bounds()
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "P5\n%d %d\n255\n", b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			w.WriteByte(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return w.Flush()
+}
+
+// contents of the -sidecar JSON file
+type sidecar struct {
+	Source      string   `json:"source"`
+	URL         string   `json:"url,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Date        string   `json:"date"`
+	Width       int      `json:"width"`
+	Height      int      `json:"height"`
+	InkCoverage *float64 `json:"ink_coverage,omitempty"`
+	DryRun      bool     `json:"dry_run,omitempty"`
+}
+
+// describe what was rendered, for dashboards and scripts
+func save_sidecar(img image.Image, path string, info fetch_info) error {
+	coverage := ink_coverage(img)
+	return encode_sidecar(path, sidecar{
+		Source:      info.source,
+		URL:         info.url,
+		Title:       info.title,
+		Date:        time.Now().In(location).Format(time.RFC3339),
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		InkCoverage: &coverage,
+	})
+}
+
+// describe what a -validate run would render, without downloading anything.
+// there is no image yet, so no title or ink coverage
+func save_plan_sidecar(path string, info fetch_info) error {
+	return encode_sidecar(path, sidecar{
+		Source: info.source,
+		URL:    info.url,
+		Date:   time.Now().In(location).Format(time.RFC3339),
+		Width:  re_width,
+		Height: re_height,
+		DryRun: true,
+	})
+}
+
+func encode_sidecar(path string, s sidecar) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// named colors accepted by parse_color
+var color_names = map[string]color.Color{
+	"black":       color.Gray{0},
+	"darkgray":    color.Gray{64},
+	"gray":        color.Gray{128},
+	"lightgray":   color.Gray{192},
+	"white":       color.Gray{255},
+	"transparent": color.Transparent,
+}
+
+// spellings which mean the same as a name in color_names
+var color_aliases = map[string]string{
+	"grey":      "gray",
+	"darkgrey":  "darkgray",
+	"lightgrey": "lightgray",
+	"none":      "transparent",
+}
+
+// parse a color given as a name (black, white, gray, ...) or a gray level
+// 0-255, optionally written as gray:N.  case insensitive, and British spellings
+// (grey) are accepted
+func parse_color(s string) (color.Color, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	name = strings.ReplaceAll(name, " ", "")
+	// gray:N is only a level, gray:black is a mistake
+	level_only := strings.HasPrefix(name, "gray:") || strings.HasPrefix(name, "grey:")
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "gray:"), "grey:")
+	if alias, ok := color_aliases[name]; ok && !level_only {
+		name = alias
+	}
+	if c, ok := color_names[name]; ok && !level_only {
+		return c, nil
+	}
+
+	level, err := strconv.Atoi(name)
+	if err != nil || level < 0 || level > 255 {
+		return nil, errors.New("invalid color: " + s)
+	}
+	return color.Gray{uint8(level)}, nil
+}
+
+// parse a border spec of the form "width,color".  empty spec means no border
+func parse_border(spec string) (int, color.Color, error) {
+	if spec == "" {
+		return 0, nil, nil
+	}
+
+	parts := strings.SplitN(spec, ",", 2)
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width < 0 {
+		return 0, nil, errors.New("invalid border width: " + parts[0])
+	}
+
+	c := color.Color(color.Gray{0})
+	if len(parts) == 2 {
+		c, err = parse_color(parts[1])
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return width, c, nil
+}
+
+// copy image so it can be drawn on, keeping *image.Gray images grayscale
+func clone(img image.Image) draw.Image {
+	if gray, ok := img.(*image.Gray); ok {
+		dst := image.NewGray(gray.Bounds())
+		draw.Draw(dst, dst.Bounds(), gray, gray.Bounds().Min, draw.Src)
+		return dst
+	}
+	return imaging.Clone(img)
+}
+
+// draw a solid border of the given width around the edges of the image
+func border(img image.Image, width int, c color.Color) image.Image {
+	if width <= 0 {
+		return img
+	}
+
+	debug("Drawing border")
+
+	dst := clone(img)
+	b := dst.Bounds()
+	src := image.NewUniform(c)
+
+	// top, bottom, left, right
+	rects := []image.Rectangle{
+		image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+width),
+		image.Rect(b.Min.X, b.Max.Y-width, b.Max.X, b.Max.Y),
+		image.Rect(b.Min.X, b.Min.Y, b.Min.X+width, b.Max.Y),
+		image.Rect(b.Max.X-width, b.Min.Y, b.Max.X, b.Max.Y),
+	}
+	for _, r := range rects {
+		draw.Draw(dst, r.Intersect(b), src, image.Point{}, draw.Over)
+	}
+
+	return dst
+}
+
+// fraction of pixels which are darker than mid-gray
+func ink_coverage(img image.Image) float64 {
+	var histogram [256]int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			histogram[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+		}
+	}
+
+	dark := 0
+	for level := 0; level < 128; level++ {
+		dark += histogram[level]
+	}
+
+	return float64(dark) / float64(b.Dx()*b.Dy())
+}
+
+// parse an aspect ratio of the form "w:h", or "panel" for the display aspect.
+// empty spec means no cropping
+func parse_aspect(spec string) (float64, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	if spec == "panel" {
+		return float64(re_width) / float64(re_height), nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("invalid aspect ratio: " + spec)
+	}
+	w, err1 := strconv.ParseFloat(parts[0], 64)
+	h, err2 := strconv.ParseFloat(parts[1], 64)
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, errors.New("invalid aspect ratio: " + spec)
+	}
+	return w / h, nil
+}
+
+// crop the center of the image to the given width/height ratio
+func crop_aspect(img image.Image, aspect float64) image.Image {
+	if aspect <= 0 {
+		return img
+	}
+
+	debug("Cropping to aspect ratio")
+
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	if float64(width)/float64(height) > aspect {
+		width = int(float64(height)*aspect + 0.5)
+	} else {
+		height = int(float64(width)/aspect + 0.5)
+	}
+
+	b := img.Bounds()
+	x := (b.Dx() - width) / 2
+	y := (b.Dy() - height) / 2
+	return crop(img, image.Rect(x, y, x+width, y+height))
+}
+
+// crop rect (relative to the image origin), keeping *image.Gray images grayscale
+func crop(img image.Image, rect image.Rectangle) image.Image {
+	if gray, ok := img.(*image.Gray); ok {
+		return gray.SubImage(rect.Add(gray.Bounds().Min).Intersect(gray.Bounds()))
+	}
+	return imaging.Crop(img, rect)
+}
+
+// fraction of pixels whose gray level differs by more than tolerance.
+// images of different sizes differ completely
+func image_diff(a, b image.Image, tolerance int) float64 {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 1
+	}
+
+	changed := 0
+	ab, bb := a.Bounds(), b.Bounds()
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			ga := int(color.GrayModel.Convert(a.At(ab.Min.X+x, ab.Min.Y+y)).(color.Gray).Y)
+			gb := int(color.GrayModel.Convert(b.At(bb.Min.X+x, bb.Min.Y+y)).(color.Gray).Y)
+			if ga-gb > tolerance || gb-ga > tolerance {
+				changed++
+			}
+		}
+	}
+
+	return float64(changed) / float64(ab.Dx()*ab.Dy())
+}
+
+// parse a tile spec of the form "path,alpha=N" and load the tile image.
+// alpha defaults to 32.  empty spec means no tiling
+func parse_tile(spec string) (image.Image, uint8, error) {
+	if spec == "" {
+		return nil, 0, nil
+	}
+
+	parts := strings.Split(spec, ",")
+	alpha := 32
+	for _, option := range parts[1:] {
+		value := strings.TrimPrefix(option, "alpha=")
+		a, err := strconv.Atoi(value)
+		if value == option || err != nil || a < 0 || a > 255 {
+			return nil, 0, errors.New("invalid tile option: " + option)
+		}
+		alpha = a
+	}
+
+	tile, err := imaging.Open(parts[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	return tile, uint8(alpha), nil
+}
+
+// repeat tile across the whole image at the given opacity, starting from the
+// top left corner
+func tile(img image.Image, tile image.Image, alpha uint8) image.Image {
+	if tile == nil || alpha == 0 {
+		return img
+	}
+
+	debug("Tiling watermark")
+
+	dst := clone(img)
+	b := dst.Bounds()
+	t := tile.Bounds()
+	mask := image.NewUniform(color.Alpha{alpha})
+	for y := b.Min.Y; y < b.Max.Y; y += t.Dy() {
+		for x := b.Min.X; x < b.Max.X; x += t.Dx() {
+			r := image.Rect(x, y, x+t.Dx(), y+t.Dy()).Intersect(b)
+			draw.DrawMask(dst, r, tile, t.Min, mask, image.Point{}, draw.Over)
+		}
+	}
+
+	return dst
+}
+
+// render a line of text with the builtin 7x13 font, enlarged by an integer scale
+func render_text(text string, fg, bg color.Color, scale int) image.Image {
+	face := basicfont.Face7x13
+	d := font.Drawer{Face: face}
+	width := d.MeasureString(text).Ceil()
+	height := face.Metrics().Height.Ceil()
+
+	small := imaging.New(width, height, bg)
+	d.Dst = small
+	d.Src = image.NewUniform(fg)
+	d.Dot = fixed.P(0, face.Metrics().Ascent.Ceil())
+	d.DrawString(text)
+
+	if scale <= 1 {
+		return small
+	}
+	return imaging.Resize(small, width*scale, height*scale, imaging.NearestNeighbor)
+}
+
+// draw a small gray timestamp in the bottom right corner
+func stamp(img image.Image, t time.Time) image.Image {
+	debug("Drawing timestamp")
+
+	dst := clone(img)
+	b := dst.Bounds()
+	text := render_text(t.Format("2006-01-02 15:04 MST"), color.Gray{128}, color.White, 1)
+	offset := image.Pt(b.Max.X-text.Bounds().Dx()-8, b.Max.Y-text.Bounds().Dy()-8)
+	draw.Draw(dst, text.Bounds().Add(offset).Intersect(b), text, image.Point{}, draw.Src)
+
+	return dst
+}
+
+// place two images side by side (vertical split) or one above the other
+// (horizontal split), separated by a divider line.  each image should already
+// be sized to fill its half
+func split(a, b image.Image, direction string) image.Image {
+	debug("Joining split images")
+
+	dst := image.NewNRGBA(image.Rect(0, 0, re_width, re_height))
+	second := image.Rect(re_width/2, 0, re_width, re_height)
+	divider := image.Rect(re_width/2-1, 0, re_width/2+1, re_height)
+	if direction == "horizontal" {
+		second = image.Rect(0, re_height/2, re_width, re_height)
+		divider = image.Rect(0, re_height/2-1, re_width, re_height/2+1)
+	}
+
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, a.Bounds().Sub(a.Bounds().Min), a, a.Bounds().Min, draw.Src)
+	draw.Draw(dst, second, b, b.Bounds().Min, draw.Src)
+	draw.Draw(dst, divider, image.Black, image.Point{}, draw.Src)
+
+	return dst
+}
+
+// swap light and dark, keeping *image.Gray images grayscale
+func invert(img image.Image) image.Image {
+	debug("Inverting image")
+
+	if gray, ok := img.(*image.Gray); ok {
+		dst := clone(gray).(*image.Gray)
+		for i := range dst.Pix {
+			dst.Pix[i] = 255 - dst.Pix[i]
+		}
+		return dst
+	}
+	return imaging.Invert(img)
+}
+
+// brightness multipliers for -vignette, 0-255 per pixel, kept between refreshes
+var vignette_map struct {
+	size     image.Point
+	strength float64
+	scale    []uint8
+}
+
+// darken the image towards the corners by up to strength (0-1), falling off
+// with the square of the distance from the center
+func vignette(img image.Image, strength float64) image.Image {
+	if strength <= 0 {
+		return img
+	}
+
+	debug("Drawing vignette")
+
+	b := img.Bounds()
+	if vignette_map.size != b.Size() || vignette_map.strength != strength {
+		w, h := b.Dx(), b.Dy()
+		scale := make([]uint8, w*h)
+		cx, cy := float64(w)/2, float64(h)/2
+		corner := cx*cx + cy*cy
+		for y := 0; y < h; y++ {
+			dy := float64(y) + 0.5 - cy
+			for x := 0; x < w; x++ {
+				dx := float64(x) + 0.5 - cx
+				scale[y*w+x] = uint8(255*(1-strength*(dx*dx+dy*dy)/corner) + 0.5)
+			}
+		}
+		vignette_map.size, vignette_map.strength, vignette_map.scale = b.Size(), strength, scale
+	}
+	scale := vignette_map.scale
+
+	if gray, ok := img.(*image.Gray); ok {
+		dst := clone(gray).(*image.Gray)
+		for y := 0; y < b.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride : y*dst.Stride+b.Dx()]
+			for x := range row {
+				row[x] = uint8(int(row[x]) * int(scale[y*b.Dx()+x]) / 255)
+			}
+		}
+		return dst
+	}
+
+	dst := imaging.Clone(img)
+	for y := 0; y < b.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+b.Dx()*4]
+		for x := 0; x < b.Dx(); x++ {
+			s := int(scale[y*b.Dx()+x])
+			for c := 0; c < 3; c++ {
+				row[x*4+c] = uint8(int(row[x*4+c]) * s / 255)
+			}
+		}
+	}
+	return dst
+}
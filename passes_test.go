@@ -0,0 +1,96 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		spec string
+		want color.Color
+		ok   bool
+	}{
+		{"White", color.Gray{255}, true},
+		{"GREY", color.Gray{128}, true},
+		{"darkGrey", color.Gray{64}, true},
+		{"light gray", color.Gray{192}, true},
+		{"none", color.Transparent, true},
+		{"gray:40", color.Gray{40}, true},
+		{"grey:40", color.Gray{40}, true},
+		{"200", color.Gray{200}, true},
+		{"gray:black", nil, false},
+		{"gray:", nil, false},
+		{"256", nil, false},
+		{"-1", nil, false},
+		{"purple", nil, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		got, err := parse_color(test.spec)
+		if (err == nil) != test.ok {
+			t.Errorf("parse_color(%q) err = %v, want ok = %v", test.spec, err, test.ok)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("parse_color(%q) = %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+// a grayscale newspaper-sized page, larger than the display like most scans
+func test_page() *image.Gray {
+	page := image.NewGray(image.Rect(0, 0, 2480, 3508))
+	for i := range page.Pix {
+		page.Pix[i] = uint8(i * 7)
+	}
+	return page
+}
+
+// compare the *image.Gray fast path against the same page as NRGBA.  run with
+// -benchmem to see the allocation difference
+func BenchmarkAdjustGray(b *testing.B) {
+	page := test_page()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adjust_to(page, re_width, re_height, "fill", 1, "bilinear")
+	}
+}
+
+func BenchmarkAdjustNRGBA(b *testing.B) {
+	page := imaging.Clone(test_page())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adjust_to(page, re_width, re_height, "fill", 1, "bilinear")
+	}
+}
+
+// a grayscale page of small black text on white, like a newspaper scan
+func test_scan() *image.Gray {
+	scan := image.NewGray(image.Rect(0, 0, 2480, 3508))
+	draw.Draw(scan, scan.Bounds(), image.White, image.Point{}, draw.Src)
+	line := render_text("The quick brown fox jumps over the lazy dog 0123456789", color.Black, color.White, 2)
+	for y := 0; y < scan.Bounds().Dy(); y += line.Bounds().Dy() + 4 {
+		for x := 0; x < scan.Bounds().Dx(); x += line.Bounds().Dx() {
+			draw.Draw(scan, line.Bounds().Add(image.Pt(x, y)), line, image.Point{}, draw.Src)
+		}
+	}
+	return scan
+}
+
+// cost of each -resize filter scaling a text-heavy scan to the display width
+func BenchmarkResize(b *testing.B) {
+	scan := test_scan()
+	for _, filter := range []string{"nearest", "bilinear", "area", "lanczos"} {
+		b.Run(filter, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resize_image(scan, re_width, filter)
+			}
+		})
+	}
+}
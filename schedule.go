@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// source to use between two times of day, in minutes after midnight
+type schedule_entry struct {
+	start  int
+	end    int
+	source string
+}
+
+// repeatable -schedule flag
+type schedule_list []schedule_entry
+
+// parse time of day of the form "HH:MM"
+func parse_clock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("invalid time of day: " + s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *schedule_list) String() string {
+	var entries []string
+	for _, e := range *s {
+		entries = append(entries, e.source)
+	}
+	return strings.Join(entries, ",")
+}
+
+// parse an entry of the form "HH:MM-HH:MM=source", where source is a builtin
+// source name or URL
+func (s *schedule_list) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	times := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(times) != 2 || parts[1] == "" {
+		return errors.New("schedule must be of the form HH:MM-HH:MM=source")
+	}
+
+	start, err := parse_clock(times[0])
+	if err != nil {
+		return err
+	}
+	end, err := parse_clock(times[1])
+	if err != nil {
+		return err
+	}
+
+	*s = append(*s, schedule_entry{start, end, parts[1]})
+	return nil
+}
+
+// find the first source whose time range contains t.  ranges may wrap past
+// midnight, and a range which ends where it starts covers the whole day
+func (s schedule_list) pick(t time.Time) (string, bool) {
+	now := t.Hour()*60 + t.Minute()
+	for _, e := range s {
+		if e.start == e.end {
+			return e.source, true
+		}
+		if e.start < e.end && now >= e.start && now < e.end {
+			return e.source, true
+		}
+		if e.start > e.end && (now >= e.start || now < e.end) {
+			return e.source, true
+		}
+	}
+	return "", false
+}
+
+// whether every minute of the day has a scheduled source
+func (s schedule_list) all_day() bool {
+	midnight := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for minute := 0; minute < 24*60; minute++ {
+		if _, ok := s.pick(midnight.Add(time.Duration(minute) * time.Minute)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parse a date range of the form "YYYY-MM-DD..YYYY-MM-DD" in the configured timezone
+func parse_range(s string) (time.Time, time.Time, error) {
+	parts := strings.SplitN(s, "..", 2)
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, errors.New("range must be of the form YYYY-MM-DD..YYYY-MM-DD")
+	}
+
+	start, err := time.ParseInLocation("2006-01-02", parts[0], location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := time.ParseInLocation("2006-01-02", parts[1], location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("range end is before start")
+	}
+
+	return start, end, nil
+}
+
+// dark theme hours for -auto-theme when no -lat/-lon is given
+var night = schedule_list{{19 * 60, 7 * 60, "dark"}}
+
+// sunrise and sunset on the day of t at the given latitude/longitude (degrees,
+// north and east positive), using the sunrise equation.  during polar day or
+// night both are zero and day tells which
+func sun_times(t time.Time, lat, lon float64) (rise, set time.Time, day bool) {
+	rad := math.Pi / 180
+	noon := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, time.UTC)
+
+	// days since the J2000 epoch, corrected to mean solar noon at lon
+	n := math.Round(float64(noon.Unix())/86400+2440587.5-2451545.0+0.0008) - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*n, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + n + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*ecliptic*rad)
+	declination := math.Asin(math.Sin(ecliptic*rad) * math.Sin(23.4397*rad))
+
+	cos_hour := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*math.Sin(declination)) /
+		(math.Cos(lat*rad) * math.Cos(declination))
+	if cos_hour < -1 || cos_hour > 1 {
+		return time.Time{}, time.Time{}, cos_hour < -1
+	}
+	hour := math.Acos(cos_hour) / rad
+
+	julian := func(j float64) time.Time {
+		return time.Unix(int64((j-2440587.5)*86400), 0).In(t.Location())
+	}
+	return julian(transit - hour/360), julian(transit + hour/360), true
+}
+
+// whether -auto-theme should use the dark theme at t.  without coordinates the
+// fixed night hours are used instead
+func is_dark(t time.Time, coords bool, lat, lon float64) bool {
+	if !coords {
+		_, dark := night.pick(t)
+		return dark
+	}
+	rise, set, day := sun_times(t, lat, lon)
+	if rise.IsZero() {
+		return !day
+	}
+	return t.Before(rise) || !t.Before(set)
+}
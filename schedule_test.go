@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	zone := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip("no timezone data:", err)
+		}
+		return loc
+	}
+	tests := []struct {
+		place    string
+		date     time.Time
+		lat, lon float64
+		rise     string
+		set      string
+	}{
+		{"London", time.Date(2026, 10, 14, 12, 0, 0, 0, zone("Europe/London")), 51.5, -0.13, "07:22", "18:11"},
+		{"Los Angeles", time.Date(2026, 6, 21, 12, 0, 0, 0, zone("America/Los_Angeles")), 34.05, -118.24, "05:42", "20:08"},
+		{"Tokyo", time.Date(2026, 12, 21, 12, 0, 0, 0, zone("Asia/Tokyo")), 35.68, 139.69, "06:47", "16:32"},
+		{"Null Island", time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC), 0, 0, "06:04", "18:11"},
+	}
+	for _, test := range tests {
+		rise, set, day := sun_times(test.date, test.lat, test.lon)
+		if !day || rise.IsZero() {
+			t.Errorf("%s: got no sunrise", test.place)
+			continue
+		}
+		for _, c := range []struct {
+			name string
+			got  time.Time
+			want string
+		}{{"sunrise", rise, test.rise}, {"sunset", set, test.set}} {
+			want, _ := time.ParseInLocation("15:04", c.want, test.date.Location())
+			want = time.Date(test.date.Year(), test.date.Month(), test.date.Day(),
+				want.Hour(), want.Minute(), 0, 0, test.date.Location())
+			if diff := c.got.Sub(want); diff < -3*time.Minute || diff > 3*time.Minute {
+				t.Errorf("%s: %s at %s, want %s", test.place, c.name, c.got.Format("15:04"), c.want)
+			}
+		}
+	}
+}
+
+func TestSunTimesPolar(t *testing.T) {
+	// Svalbard has midnight sun in June and polar night in December
+	if _, _, day := sun_times(time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC), 78, 15); !day {
+		t.Error("June in Svalbard: got polar night, want polar day")
+	}
+	if _, _, day := sun_times(time.Date(2026, 12, 21, 12, 0, 0, 0, time.UTC), 78, 15); day {
+		t.Error("December in Svalbard: got polar day, want polar night")
+	}
+}
+
+func TestIsDark(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 3, 20, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		t      time.Time
+		coords bool
+		want   bool
+	}{
+		// fixed night hours, 19:00-07:00
+		{at(6, 59), false, true},
+		{at(7, 0), false, false},
+		{at(18, 59), false, false},
+		{at(19, 0), false, true},
+		// 0,0 given explicitly uses the sun, which sets around 18:11
+		{at(18, 30), true, true},
+		{at(6, 30), true, false},
+	}
+	for _, test := range tests {
+		if got := is_dark(test.t, test.coords, 0, 0); got != test.want {
+			t.Errorf("is_dark(%s, coords=%v) = %v, want %v", test.t.Format("15:04"), test.coords, got, test.want)
+		}
+	}
+}
+
+func TestSchedulePick(t *testing.T) {
+	var s schedule_list
+	for _, entry := range []string{"07:00-12:00=morning", "22:00-06:00=night"} {
+		if err := s.Set(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{at(7, 0), "morning"},
+		{at(11, 59), "morning"},
+		{at(12, 0), ""},
+		{at(21, 59), ""},
+		{at(22, 0), "night"},
+		{at(0, 0), "night"},
+		{at(5, 59), "night"},
+		{at(6, 0), ""},
+	}
+	for _, test := range tests {
+		got, ok := s.pick(test.t)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("pick(%s) = %q, %v, want %q", test.t.Format("15:04"), got, ok, test.want)
+		}
+	}
+
+	var all schedule_list
+	all.Set("00:00-00:00=always")
+	if got, ok := all.pick(at(13, 37)); !ok || got != "always" {
+		t.Errorf("equal start and end: pick = %q, %v, want always", got, ok)
+	}
+	if !all.all_day() || s.all_day() {
+		t.Error("all_day wrong")
+	}
+
+	for _, bad := range []string{"07:00=x", "07:00-08:00=", "7am-8am=x", "25:00-01:00=x"} {
+		if err := s.Set(bad); err == nil {
+			t.Errorf("Set(%q) accepted invalid entry", bad)
+		}
+	}
+}
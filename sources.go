@@ -3,9 +3,17 @@ package main
 import (
 	"image"
 	"image/color"
+	"image/draw"
 	"net/http"
+	"net/url"
+	"errors"
 	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 
@@ -13,59 +21,213 @@ import (
 	"github.com/nfnt/resize"
 )
 
+// description of the last downloaded image, for -sidecar
+type fetch_info struct {
+	source string
+	url string
+	title string
+}
+
+var fetched fetch_info
+
 var sources = map[string] func() (image.Image, error) {
 	"natgeo": natgeo,
+	"stdin": stdin,
+	"blank": blank,
+}
+
+// repeatable -source flag, tried in order until one succeeds
+type source_list []string
+
+func (s *source_list) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *source_list) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// find a builtin source by name.  "solid:<color>" gives a plain canvas of that
+// color, "dir:<path>" picks an image from a local directory
+func lookup_source(name string) (func() (image.Image, error), bool) {
+	if strings.HasPrefix(name, "dir:") {
+		path := strings.TrimPrefix(name, "dir:")
+		return func() (image.Image, error) {
+			return directory(path)
+		}, true
+	}
+	if strings.HasPrefix(name, "solid:") {
+		c, err := parse_color(strings.TrimPrefix(name, "solid:"))
+		if err != nil {
+			return nil, false
+		}
+		return func() (image.Image, error) {
+			return image.NewUniform(c), nil
+		}, true
+	}
+
+	source, ok := sources[name]
+	return source, ok
+}
+
+// strategy for choosing an image from a directory source (random, sequential, daily)
+var pick = "random"
+
+// image files in a directory which imaging can decode, sorted by name
+func list_images(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if _, err := imaging.FormatFromFilename(entry.Name()); err == nil && !entry.IsDir() {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no images found in " + path)
+	}
+	return files, nil
+}
+
+// pick an image from a directory of photos, for an offline photo frame
+func directory(path string) (image.Image, error) {
+	files, err := list_images(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var index int
+	switch pick {
+	case "sequential":
+		// remember the last image shown between runs
+		state := filepath.Join(path, ".renews-index")
+		if data, err := os.ReadFile(state); err == nil {
+			last, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			index = (last + 1) % len(files)
+		}
+		err = os.WriteFile(state, []byte(strconv.Itoa(index)), 0644)
+		if err != nil {
+			warn("Failed to save directory index", "path", state, "err", err.Error())
+		}
+	case "daily":
+		now := time.Now().In(location)
+		_, offset := now.Zone()
+		index = int((now.Unix() + int64(offset)) / 86400 % int64(len(files)))
+	default:
+		index = rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(files))
+	}
+
+	debug("Picked", files[index])
+	fetched.url = files[index]
+	f, err := os.Open(files[index])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decode_image(f)
+}
+
+// plain white canvas, e.g. for a minimal screen with only a -stamp
+func blank() (image.Image, error){
+	return image.NewUniform(color.Gray{255}), nil
+}
+
+// read an already downloaded image from stdin, e.g. `curl ... | renews -source stdin`
+func stdin() (image.Image, error){
+	debug("Reading image from stdin")
+
+	return decode_image(os.Stdin)
+}
+
+// urls fetched by builtin sources, used for -validate
+var source_urls = map[string] string {
+	"natgeo": "https://www.nationalgeographic.com/photography/photo-of-the-day/_jcr_content/.gallery.json",
 }
 
 func natgeo() (image.Image, error){
-	url := "https://www.nationalgeographic.com/photography/photo-of-the-day/_jcr_content/.gallery.json"
+	url := source_urls["natgeo"]
 
 	imgurl, err := get_xpath(url, "/items/*[1]/image/uri", "json")
-	check(err, "")
+	if err != nil {
+		return nil, err
+	}
 
 	caption, err := get_xpath(url, "/items/*[1]/image/caption", "json")
+	if err != nil {
+		return nil, err
+	}
 	caption = strings.TrimSuffix(strings.TrimPrefix(caption, "<p>"), "</p>\n")
 	fmt.Println(caption)
-	check(err, "")
+	fetched.title = caption
 
 	// if http failure, wait for next reconnect
-	response, err := get_url(imgurl)
+	response, err := get_image_url(imgurl)
 	if err != nil {
 		debug("Failed to fetch image")
 		return nil, err
 	}
 
-	img, err := imaging.Decode(response.Body)
+	img, err := decode_image(response.Body)
 	if err != nil {
-		debug("Failed to decode image")
 		return nil, err
 	}
 
 	return img, nil
 }
 
+// check that a candidate names a builtin source or is an http(s) URL, so typos
+// in source names aren't fetched as URLs
+func check_candidate(name string) error {
+	if _, ok := lookup_source(name); ok {
+		return nil
+	}
+	u, err := url.Parse(name)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("unknown source " + name)
+	}
+	return nil
+}
+
+// fetch a candidate, which is either a builtin source name or a URL
+func fetch_candidate(name string, format bool, xpath string) (image.Image, error) {
+	if source, ok := lookup_source(name); ok {
+		return source()
+	}
+	return custom(name, format, xpath)
+}
 
 // function for grabbing custom sources
 func custom(url string, format bool, xpath string) (image.Image, error){
 
 	debug("Beginning download")
 
+	var response *http.Response
+	var err error
+
 	// ----- URL strftime formatting -----
 
 	if format {
-		url = format_url(url)
+		url, err = format_url(url)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// ----- image XPath handling -----
 
-	var response *http.Response
-	var err error
 	// if xpath is provided, assume url is HTML
 	if xpath != "" {
 		debug("Got -xpath.  Trying to extract img url from provided url")
 
 		result, err := get_xpath(url, xpath, "html")
-		check(err, "")
+		if err != nil {
+			return nil, err
+		}
 
 		// imgurl := e.Attr[0].Val
 		imgurl, err := to_absurl(url, result)
@@ -73,22 +235,24 @@ func custom(url string, format bool, xpath string) (image.Image, error){
 		debug("Image url", imgurl)
 
 		// if http failure, wait for next reconnect
-		response, err = get_url(imgurl)
+		response, err = get_image_url(imgurl)
 		if err != nil {
 			debug("Failed to fetch image")
 			return nil, err
 		}
 
 	} else {
-		response, err = get_url(url)
-		check(err, "")
+		response, err = get_image_url(url)
+		if err != nil {
+			debug("Failed to fetch image")
+			return nil, err
+		}
 	}
 
 	// ----- image loading -----
 
-	img, err := imaging.Decode(response.Body)
+	img, err := decode_image(response.Body)
 	if err != nil {
-		debug("Failed to decode image")
 		return nil, err
 	}
 
@@ -96,35 +260,99 @@ func custom(url string, format bool, xpath string) (image.Image, error){
 
 }
 
+// reMarkable display size
+var re_width = 1404
+var re_height = 1872
+
+// display sizes of known devices, portrait
+var device_sizes = map[string] image.Point {
+	"reMarkable 1/2": {1404, 1872},
+	"reMarkable Paper Pro": {1620, 2160},
+	"reMarkable Paper Pro Move": {954, 1696},
+}
+
+// display sized canvas of a single color, grayscale if possible
+func fill(c color.Color) image.Image {
+	r := image.Rect(0, 0, re_width, re_height)
+	var dst draw.Image = image.NewNRGBA(r)
+	if _, ok := c.(color.Gray); ok {
+		dst = image.NewGray(r)
+	}
+	draw.Draw(dst, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return dst
+}
+
+// resampling filters for -resize
+var resize_filters = map[string] bool {
+	"nearest": true,
+	"bilinear": true,
+	"area": true,
+	"lanczos": true,
+}
+
+// resize image to width, preserving aspect ratio
+func resize_image(img image.Image, width int, filter string) image.Image {
+	switch filter {
+	case "nearest":
+		return resize.Resize(uint(width), 0, img, resize.NearestNeighbor)
+	case "lanczos":
+		return resize.Resize(uint(width), 0, img, resize.Lanczos3)
+	case "area":
+		// imaging widens the box filter by the downscale ratio, so each output
+		// pixel averages the source pixels it covers.  slower, but keeps small
+		// text in newspaper scans legible
+		resized := imaging.Resize(img, width, 0, imaging.Box)
+		if _, ok := img.(*image.Gray); ok {
+			gray := image.NewGray(resized.Bounds())
+			draw.Draw(gray, gray.Bounds(), resized, image.Point{}, draw.Src)
+			return gray
+		}
+		return resized
+	}
+	// imaging resize is slow for some reason, use other library
+	return resize.Resize(uint(width), 0, img, resize.Bilinear)
+}
+
 // scale, inset image to reMarkable display size
-func adjust(img image.Image, mode string, scale float64) image.Image {
+func adjust(img image.Image, mode string, scale float64, filter string) image.Image {
+	return adjust_to(img, re_width, re_height, mode, scale, filter)
+}
 
-	debug("Adjusting image")
+// scale, inset image to the given size
+func adjust_to(img image.Image, width, height int, mode string, scale float64, filter string) image.Image {
 
-	re_width := 1404
-	re_height := 1872
+	debug("Adjusting image")
 
 	if mode == "fill" {
 		// scale image to remarkable width
-		// imaging resize is slow for some reason, use other library
-		// img = imaging.Resize(img, re_width, 0, imaging.Linear)
-		img = resize.Resize(uint(re_width), 0, img, resize.Bilinear)
+		// img = imaging.Resize(img, width, 0, imaging.Linear)
+		img = resize_image(img, width, filter)
 		// cut off parts of image that overflow
-		img = imaging.Crop(img, image.Rect(0, 0, re_width, re_height))
+		img = crop(img, image.Rect(0, 0, width, height))
 
 	} else if mode == "center" {
 	} else {
 		debug("Invalid mode")
 	}
 	if scale != 1 {
-		img_width := float64(img.Bounds().Max.X)
-		img = resize.Resize(uint(scale * img_width), 0, img, resize.Bilinear)
+		img_width := float64(img.Bounds().Dx())
+		img = resize_image(img, int(scale * img_width), filter)
 	}
 
 	// put image in center of screen
+	// grayscale sources (most newspapers/comics) stay grayscale, which uses a
+	// quarter of the memory
+	if gray, ok := img.(*image.Gray); ok {
+		background := image.NewGray(image.Rect(0, 0, width, height))
+		draw.Draw(background, background.Bounds(), image.White, image.Point{}, draw.Src)
+		offset := image.Pt((width-gray.Bounds().Dx())/2, (height-gray.Bounds().Dy())/2)
+		draw.Draw(background, gray.Bounds().Sub(gray.Bounds().Min).Add(offset), gray, gray.Bounds().Min, draw.Src)
+		return background
+	}
+
 	background := imaging.New(
-		re_width,
-		re_height,
+		width,
+		height,
 		color.RGBA{255, 255, 255, 255},
 	)
 	img = imaging.PasteCenter(background, img)
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// check that the source is reachable and output is writable without
+// downloading anything or touching the output file.  returns all problems found
+func validate(source_names []string, schedule schedule_list, url string, format bool, output string) []error {
+	var problems []error
+
+	// ----- sources -----
+
+	for _, source := range source_names {
+		if _, ok := lookup_source(source); !ok {
+			problems = append(problems, errors.New("unknown source: "+source))
+		} else if err := validate_source(source); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, e := range schedule {
+		if err := validate_candidate(e.source, format); err != nil {
+			problems = append(problems, fmt.Errorf("schedule %s: %w", e.source, err))
+		}
+	}
+
+	if url != "" {
+		if err := validate_url(url, format); err != nil {
+			problems = append(problems, err)
+		}
+	} else if len(source_names) == 0 && len(schedule) == 0 {
+		problems = append(problems, errors.New("no -source or -url given"))
+	} else if len(source_names) == 0 && !schedule.all_day() {
+		problems = append(problems, errors.New("no -source or -url given for times outside -schedule"))
+	}
+
+	// ----- output -----
+
+	if output == "" {
+		problems = append(problems, errors.New("no -output given"))
+	} else {
+		// create and remove a scratch file next to the output
+		f, err := os.CreateTemp(filepath.Dir(output), ".renews-validate-*")
+		if err != nil {
+			problems = append(problems, fmt.Errorf("output not writable: %w", err))
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+
+	return problems
+}
+
+// check a builtin source, or a URL used as a candidate, e.g. by -schedule
+func validate_candidate(name string, format bool) error {
+	if _, ok := lookup_source(name); ok {
+		return validate_source(name)
+	}
+	if err := check_candidate(name); err != nil {
+		return err
+	}
+	return validate_url(name, format)
+}
+
+// check a builtin source without fetching its image
+func validate_source(source string) error {
+	if strings.HasPrefix(source, "dir:") {
+		return validate_dir(strings.TrimPrefix(source, "dir:"))
+	}
+	if source_url, ok := source_urls[source]; ok {
+		debug("Checking", source_url)
+		if err := head_url(source_url); err != nil {
+			return fmt.Errorf("source %s unreachable: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// check that a dir: source has at least one image with a readable header
+func validate_dir(path string) error {
+	files, err := list_images(path)
+	if err != nil {
+		return fmt.Errorf("source dir:%s: %w", path, err)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		_, _, err = image.DecodeConfig(f)
+		f.Close()
+		if err == nil {
+			return nil
+		}
+		debug("Undecodable image", file)
+	}
+	return errors.New("source dir:" + path + ": no decodable images")
+}
+
+func validate_url(url string, format bool) error {
+	var err error
+	if format {
+		url, err = format_url(url)
+		if err != nil {
+			return err
+		}
+	}
+	debug("Checking", url)
+	if err := head_url(url); err != nil {
+		return fmt.Errorf("url unreachable: %w", err)
+	}
+	return nil
+}